@@ -4,14 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 	"uacl/internal/auth"
 	"uacl/internal/db"
+	"uacl/internal/middlewares"
 	"uacl/internal/password"
+	"uacl/internal/secrets"
 	"uacl/messages"
 	"uacl/model"
 
@@ -20,9 +21,13 @@ import (
 	"github.com/go-chi/chi"
 )
 
-const autologinLength = 64
+const autologinTokenBytes = 48
 
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+// loginThrottle enforces LOGIN_MAX_ATTEMPTS per (ip, username) across login,
+// refreshToken and authoriseLoginToken. It falls back to an in-process
+// MemoryCounter unless a Redis-backed Counter is wired in by the caller that
+// constructs the router.
+var loginThrottle = middlewares.NewLoginThrottle(middlewares.NewMemoryCounter(middlewares.LoginWindow()))
 
 func publicKey(w http.ResponseWriter, r *http.Request) {
 	public, err := ioutil.ReadFile(os.Getenv("PUBLIC_KEY"))
@@ -55,12 +60,20 @@ func authorizeHeader(w http.ResponseWriter, r *http.Request) {
 
 func doAuthentication(r *http.Request) (model.ShortenedUser, error) {
 	header := r.Header.Get("Authorization")
-	header = strings.Split(header, "Bearer ")[1]
 
-	return auth.Validate(header)
+	parts := strings.SplitN(header, "Bearer ", 2)
+	if len(parts) != 2 {
+		return model.ShortenedUser{}, messages.ErrUnauthorised
+	}
+
+	return auth.Validate(r.Context(), parts[1])
 }
 
 func refreshToken(w http.ResponseWriter, r *http.Request) {
+	if !loginThrottle.Allow(w, r, "") {
+		return
+	}
+
 	token := model.Token{}
 
 	err := json.NewDecoder(r.Body).Decode(&token)
@@ -71,16 +84,25 @@ func refreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := auth.Validate(token.RefreshToken)
+	user, err := auth.Validate(r.Context(), token.RefreshToken)
 	if err != nil {
 		logger.Error(err)
+		loginThrottle.RecordFailure(r, "")
 		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
 
 		return
 	}
 
+	// Re-check now that the token names a username, so the failure recorded
+	// below lands on the same "ip|username" key Allow reads back - the
+	// earlier Allow(w, r, "") call only ever gated the ip-only key.
+	if !loginThrottle.Allow(w, r, user.Username) {
+		return
+	}
+
 	if !db.RefreshTokenIsValidForUsername(r.Context(), token.RefreshToken, user.Username) {
 		logger.Error(messages.ErrWrongRefreshToken)
+		loginThrottle.RecordFailure(r, user.Username)
 		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
 			Message: messages.ErrWrongRefreshToken.Error(),
 		})
@@ -88,10 +110,24 @@ func refreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passTokenToUser(r.Context(), w, &model.User{
-		Name:     user.Name,
-		Username: user.Username,
-	})
+	databaseUser, err := db.FindByUsername(r.Context(), user.Username)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if !databaseUser.LockedUntil.IsZero() && time.Now().Before(databaseUser.LockedUntil) {
+		logger.Error(messages.ErrAccountLocked)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrAccountLocked.Error(),
+		})
+
+		return
+	}
+
+	passTokenToUser(r.Context(), w, &databaseUser)
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
@@ -103,6 +139,10 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !loginThrottle.Allow(w, r, user.Username) {
+		return
+	}
+
 	target, err := user.ValidateLogin()
 	if err != nil {
 		logger.Error(err)
@@ -122,8 +162,20 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !databaseUser.LockedUntil.IsZero() && time.Now().Before(databaseUser.LockedUntil) {
+		logger.Error(messages.ErrAccountLocked)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrAccountLocked.Error(),
+		})
+
+		return
+	}
+
 	correctPassword := password.ValidatePassword(user.Password, databaseUser.Password)
 	if !correctPassword {
+		recordFailedLogin(r.Context(), databaseUser.Username)
+		loginThrottle.RecordFailure(r, user.Username)
+
 		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
 			Message: messages.ErrInvalidCredentials.Error(),
 		})
@@ -131,6 +183,28 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := db.ResetLoginFailures(r.Context(), databaseUser.Username); err != nil {
+		logger.Error(err)
+	}
+
+	if databaseUser.TOTPEnabled {
+		challengeToken, err := createOTPChallengeToken(databaseUser.Username)
+		if err != nil {
+			logger.Error(err)
+			response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+			return
+		}
+
+		logger.Infof("Awaiting OTP for user %s", user.Username)
+		response.ResultResponseJSON(w, false, http.StatusOK, otpRequiredResponse{
+			Status:         "otp_required",
+			ChallengeToken: challengeToken,
+		})
+
+		return
+	}
+
 	logger.Infof("Logging in user %s", user.Username)
 
 	passTokenToUser(r.Context(), w, &databaseUser)
@@ -188,21 +262,10 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	passTokenToUser(r.Context(), w, user)
 }
 
-func createLoginToken(w http.ResponseWriter, r *http.Request) {
-	authUser, err := doAuthentication(r)
-	if err != nil {
-		logger.Error(err)
-		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
-
-		return
-	}
-
-	authorizedUsers := strings.Split(os.Getenv("AUTOLOGIN_CREATE_USERS"), ",")
-
-	in := stringInSlice(authUser.Username, authorizedUsers)
-	if !in {
-		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: "no authorized"})
+const autologinCreateScope = "autologin:create"
 
+func createLoginToken(w http.ResponseWriter, r *http.Request) {
+	if _, ok := middlewares.AuthoriseScope(w, r, autologinCreateScope); !ok {
 		return
 	}
 
@@ -223,9 +286,13 @@ func createLoginToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rand.Seed(time.Now().UnixNano())
+	id, err := secrets.NewToken(autologinTokenBytes)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
 
-	id := RandStringRunes(autologinLength)
+		return
+	}
 
 	err = db.CreateNewAutologinToken(r.Context(), dbUser.Username, id)
 	if err != nil {
@@ -246,11 +313,16 @@ func createLoginToken(w http.ResponseWriter, r *http.Request) {
 }
 
 func authoriseLoginToken(w http.ResponseWriter, r *http.Request) {
+	if !loginThrottle.Allow(w, r, "") {
+		return
+	}
+
 	autologinToken := chi.URLParam(r, "token")
 
 	autoLoginRequest, err := db.FindAutologinForUser(r.Context(), autologinToken)
 	if err != nil {
 		logger.Error(err)
+		loginThrottle.RecordFailure(r, "")
 		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
 
 		return
@@ -286,10 +358,11 @@ func passTokenToUser(ctx context.Context, w http.ResponseWriter, user *model.Use
 	}
 
 	token := model.Token{
-		Username:     user.Username,
-		Token:        tokenString,
-		RefreshToken: refreshTokenString,
-		UpdatedAt:    time.Now(),
+		Username:         user.Username,
+		Token:            tokenString,
+		RefreshToken:     refreshTokenString,
+		UpdatedAt:        time.Now(),
+		TwoFactorEnabled: user.TOTPEnabled,
 	}
 
 	err = db.UpsertToken(ctx, &token)
@@ -302,23 +375,3 @@ func passTokenToUser(ctx context.Context, w http.ResponseWriter, user *model.Use
 
 	response.ResultResponseJSON(w, false, http.StatusCreated, token)
 }
-
-func RandStringRunes(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		//nolint
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
-	}
-
-	return string(b)
-}
-
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
-		}
-	}
-
-	return false
-}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+	"uacl/internal/db"
+	"uacl/internal/middlewares"
+	"uacl/messages"
+
+	"github.com/TomBowyerResearchProject/common/logger"
+	"github.com/TomBowyerResearchProject/common/response"
+)
+
+const adminUnlockScope = "admin:unlock"
+
+const (
+	lockoutThreshold = 10
+	lockoutDuration  = 15 * time.Minute
+)
+
+type unlockAccountRequest struct {
+	Username string `json:"username"`
+}
+
+// recordFailedLogin increments the username's consecutive failure count and
+// locks the account once it crosses lockoutThreshold, independent of the
+// per-IP sliding window enforced by middlewares.LoginThrottle.
+func recordFailedLogin(ctx context.Context, username string) {
+	failures, err := db.RecordLoginFailure(ctx, username)
+	if err != nil {
+		logger.Error(err)
+
+		return
+	}
+
+	if failures < lockoutThreshold {
+		return
+	}
+
+	if err := db.LockAccountUntil(ctx, username, time.Now().Add(lockoutDuration)); err != nil {
+		logger.Error(err)
+
+		return
+	}
+
+	logger.Error(messages.ErrAccountLocked)
+}
+
+// adminUnlock clears a locked account's failure count ahead of its natural
+// expiry, gated by the admin:unlock scope.
+func adminUnlock(w http.ResponseWriter, r *http.Request) {
+	if _, ok := middlewares.AuthoriseScope(w, r, adminUnlockScope); !ok {
+		return
+	}
+
+	body := &unlockAccountRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := db.UnlockAccount(r.Context(), body.Username); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	logger.Infof("Unlocked account %s", body.Username)
+
+	response.MessageResponseJSON(w, false, http.StatusOK, response.Message{Message: "account unlocked"})
+}
@@ -0,0 +1,491 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"uacl/internal/auth"
+	"uacl/internal/clients"
+	"uacl/internal/db"
+	"uacl/internal/middlewares"
+	"uacl/internal/secrets"
+	"uacl/messages"
+	"uacl/model"
+
+	"github.com/TomBowyerResearchProject/common/logger"
+	"github.com/TomBowyerResearchProject/common/response"
+)
+
+const (
+	authorizationCodeLength = 32
+	expirationTimeSeconds   = 100000 * 60
+)
+
+// oidcConfigurationResponse is the subset of the OIDC discovery document
+// (https://openid.net/specs/openid-connect-discovery-1_0.html) uacl supports.
+type oidcConfigurationResponse struct {
+	Issuer                           string   `json:"issuer"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	UserinfoEndpoint                 string   `json:"userinfo_endpoint"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type userinfoResponse struct {
+	Sub               string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+// consentResponse is rendered by the client app's consent screen before it
+// resubmits the /authorize request with consent=granted.
+type consentResponse struct {
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+}
+
+// oidcConfiguration serves the OIDC discovery document at
+// /.well-known/openid-configuration.
+func oidcConfiguration(w http.ResponseWriter, r *http.Request) {
+	issuer := os.Getenv("OIDC_ISSUER")
+
+	alg, err := auth.SigningAlg()
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	response.ResultResponseJSON(w, false, http.StatusOK, oidcConfigurationResponse{
+		Issuer:                 issuer,
+		AuthorizationEndpoint:  issuer + "/authorize",
+		TokenEndpoint:          issuer + "/token",
+		UserinfoEndpoint:       issuer + "/userinfo",
+		JWKSURI:                issuer + "/jwks.json",
+		ResponseTypesSupported: []string{"code"},
+		GrantTypesSupported: []string{
+			"authorization_code", "refresh_token", "client_credentials",
+		},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{alg},
+		CodeChallengeMethodsSupported:    []string{"S256", "plain"},
+	})
+}
+
+func jwksEndpoint(w http.ResponseWriter, r *http.Request) {
+	keys, err := auth.JWKS()
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	response.ResultResponseJSON(w, false, http.StatusOK, keys)
+}
+
+// authorize starts the authorization_code flow. It requires the resource
+// owner to already be authenticated with a uacl access token (passed as a
+// Bearer token), validates the client and redirect URI, and redirects back
+// to the client with a freshly minted code.
+func authorize(w http.ResponseWriter, r *http.Request) {
+	user, err := doAuthentication(r)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrUnauthorised.Error(),
+		})
+
+		return
+	}
+
+	query := r.URL.Query()
+
+	clientID := query.Get("client_id")
+	redirectURI := query.Get("redirect_uri")
+	responseType := query.Get("response_type")
+
+	if responseType != "code" {
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: "unsupported response_type",
+		})
+
+		return
+	}
+
+	store := clients.NewStore(db.Connection())
+
+	client, err := store.FindByID(r.Context(), clientID)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := store.ValidateRequest(client, "authorization_code", redirectURI); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if redirectURI == "" {
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: clients.ErrRedirectURINotAllowed.Error(),
+		})
+
+		return
+	}
+
+	if query.Get("consent") != "granted" {
+		response.ResultResponseJSON(w, false, http.StatusOK, consentResponse{
+			ClientName: client.Name,
+			Scopes:     client.Scopes,
+		})
+
+		return
+	}
+
+	code, err := secrets.NewToken(authorizationCodeLength)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	codeStore := clients.NewCodeStore(db.Connection())
+
+	err = codeStore.Create(r.Context(), clients.AuthorizationCode{
+		Code:                code,
+		ClientID:            clientID,
+		Username:            user.Username,
+		RedirectURI:         redirectURI,
+		Scope:               query.Get("scope"),
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+		ExpiresAt:           clients.NewExpiry(),
+	})
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	logger.Infof("Issued authorization code to %s for client %s", user.Username, clientID)
+
+	redirectTo, err := url.Parse(redirectURI)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	params := redirectTo.Query()
+	params.Set("code", code)
+
+	if state := query.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+
+	redirectTo.RawQuery = params.Encode()
+
+	http.Redirect(w, r, redirectTo.String(), http.StatusFound)
+}
+
+// token implements the OAuth2 token endpoint for the authorization_code,
+// refresh_token and client_credentials grants.
+func token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	switch r.Form.Get("grant_type") {
+	case "authorization_code":
+		tokenFromAuthorizationCode(w, r)
+	case "refresh_token":
+		tokenFromRefreshToken(w, r)
+	case "client_credentials":
+		tokenFromClientCredentials(w, r)
+	default:
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: "unsupported grant_type",
+		})
+	}
+}
+
+func tokenFromAuthorizationCode(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.Form.Get("client_id")
+		clientSecret = r.Form.Get("client_secret")
+	}
+
+	if !loginThrottle.Allow(w, r, clientID) {
+		return
+	}
+
+	store := clients.NewStore(db.Connection())
+
+	client, err := store.Authenticate(r.Context(), clientID, clientSecret)
+	if err != nil {
+		logger.Error(err)
+		loginThrottle.RecordFailure(r, clientID)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	codeStore := clients.NewCodeStore(db.Connection())
+
+	code, err := codeStore.Redeem(r.Context(), r.Form.Get("code"), r.Form.Get("code_verifier"))
+	if err != nil {
+		logger.Error(err)
+		loginThrottle.RecordFailure(r, clientID)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if code.ClientID != client.ID || code.RedirectURI != r.Form.Get("redirect_uri") {
+		loginThrottle.RecordFailure(r, clientID)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: messages.ErrInvalid.Error(),
+		})
+
+		return
+	}
+
+	databaseUser, err := db.FindByUsername(r.Context(), code.Username)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	scopes := narrowScopes(client.Scopes, strings.Fields(code.Scope))
+	if len(scopes) > 0 {
+		scopes = narrowScopes(databaseUser.Scopes, scopes)
+	}
+
+	writeTokenResponse(r, w, &databaseUser, client.ID, code.Nonce, scopes, true, true)
+}
+
+// tokenFromRefreshToken exchanges a previously issued refresh token for a
+// fresh access/refresh pair, mirroring refreshToken's validation.
+func tokenFromRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if !loginThrottle.Allow(w, r, "") {
+		return
+	}
+
+	refreshTokenString := r.Form.Get("refresh_token")
+
+	user, err := auth.Validate(r.Context(), refreshTokenString)
+	if err != nil {
+		logger.Error(err)
+		loginThrottle.RecordFailure(r, "")
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	// Re-check now that the token names a username, so the failure recorded
+	// below lands on the same "ip|username" key Allow reads back - the
+	// earlier Allow(w, r, "") call only ever gated the ip-only key.
+	if !loginThrottle.Allow(w, r, user.Username) {
+		return
+	}
+
+	if !db.RefreshTokenIsValidForUsername(r.Context(), refreshTokenString, user.Username) {
+		logger.Error(messages.ErrWrongRefreshToken)
+		loginThrottle.RecordFailure(r, user.Username)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrWrongRefreshToken.Error(),
+		})
+
+		return
+	}
+
+	databaseUser, err := db.FindByUsername(r.Context(), user.Username)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if !databaseUser.LockedUntil.IsZero() && time.Now().Before(databaseUser.LockedUntil) {
+		logger.Error(messages.ErrAccountLocked)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrAccountLocked.Error(),
+		})
+
+		return
+	}
+
+	writeTokenResponse(r, w, &databaseUser, r.Form.Get("client_id"), "", databaseUser.Scopes, false, true)
+}
+
+func tokenFromClientCredentials(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.Form.Get("client_id")
+		clientSecret = r.Form.Get("client_secret")
+	}
+
+	if !loginThrottle.Allow(w, r, clientID) {
+		return
+	}
+
+	store := clients.NewStore(db.Connection())
+
+	client, err := store.Authenticate(r.Context(), clientID, clientSecret)
+	if err != nil {
+		logger.Error(err)
+		loginThrottle.RecordFailure(r, clientID)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := store.ValidateRequest(client, "client_credentials", ""); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	scopes := narrowScopes(client.Scopes, strings.Fields(r.Form.Get("scope")))
+
+	// RFC 6749 §4.4.3: the client_credentials grant has no end user and no
+	// later client to hand the refresh token to, so don't issue one.
+	writeTokenResponse(r, w, &model.User{Username: client.ID, Name: client.Name}, client.ID, "", scopes, false, false)
+}
+
+// narrowScopes returns the scopes in requested that client also carries, so
+// a token never ends up with more access than either side granted. An empty
+// requested list (no scope asked for) falls back to everything client has.
+func narrowScopes(client, requested []string) []string {
+	if len(requested) == 0 {
+		return client
+	}
+
+	var granted []string
+
+	for _, scope := range requested {
+		if middlewares.HasScope(client, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	return granted
+}
+
+// writeTokenResponse issues an access token - scoped to scopes rather than
+// the subject's full grant - via the existing token-issuance path, an OIDC
+// ID token for the authorization_code flow, and a refresh token whenever
+// issueRefresh says the grant is allowed one.
+func writeTokenResponse(
+	r *http.Request, w http.ResponseWriter, user *model.User, clientID, nonce string,
+	scopes []string, includeIDToken, issueRefresh bool,
+) {
+	scopedUser := *user
+	scopedUser.Scopes = scopes
+
+	tokenString, err := auth.CreateToken(scopedUser, false)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	var refreshTokenString string
+
+	if issueRefresh {
+		refreshTokenString, err = auth.CreateToken(scopedUser, true)
+		if err != nil {
+			logger.Error(err)
+			response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+			return
+		}
+	}
+
+	var idToken string
+
+	if includeIDToken {
+		idToken, err = auth.CreateIDToken(scopedUser, clientID, nonce)
+		if err != nil {
+			logger.Error(err)
+			response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+			return
+		}
+	}
+
+	err = db.UpsertToken(r.Context(), &model.Token{
+		Username:     user.Username,
+		Token:        tokenString,
+		RefreshToken: refreshTokenString,
+		UpdatedAt:    time.Now(),
+	})
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	response.ResultResponseJSON(w, false, http.StatusOK, oauthTokenResponse{
+		AccessToken:  tokenString,
+		RefreshToken: refreshTokenString,
+		IDToken:      idToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    expirationTimeSeconds,
+	})
+}
+
+// userinfo returns OIDC standard claims for the user identified by the
+// bearer access token, mirroring authorizeHeader but with OIDC field names.
+func userinfo(w http.ResponseWriter, r *http.Request) {
+	user, err := doAuthentication(r)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrUnauthorised.Error(),
+		})
+
+		return
+	}
+
+	response.ResultResponseJSON(w, false, http.StatusOK, userinfoResponse{
+		Sub:               user.Username,
+		PreferredUsername: user.Username,
+		Name:              user.Name,
+	})
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"uacl/internal/db"
+	"uacl/internal/mailer"
+	"uacl/internal/password"
+	"uacl/internal/secrets"
+	"uacl/messages"
+	"uacl/model"
+
+	"github.com/TomBowyerResearchProject/common/logger"
+	"github.com/TomBowyerResearchProject/common/response"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	resetSelectorBytes = 12
+	resetVerifierBytes = 32
+	resetTokenLifetime = 30 * time.Minute
+)
+
+type forgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// forgotPassword emails a single-use reset link. It always reports success,
+// even for an unknown username, so the endpoint can't be used to enumerate
+// accounts.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	body := &forgotPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	databaseUser, err := db.FindByUsername(r.Context(), body.Username)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusOK, response.Message{
+			Message: "if that account exists, a reset email has been sent",
+		})
+
+		return
+	}
+
+	selector, err := secrets.NewToken(resetSelectorBytes)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	verifier, err := secrets.NewToken(resetVerifierBytes)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	verifierHash, err := bcrypt.GenerateFromPassword([]byte(verifier), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	err = db.CreatePasswordReset(r.Context(), db.PasswordReset{
+		Username:     databaseUser.Username,
+		Selector:     selector,
+		VerifierHash: string(verifierHash),
+		ExpiresAt:    time.Now().Add(resetTokenLifetime),
+	})
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	resetLink := fmt.Sprintf("%s?token=%s.%s", os.Getenv("RESET_URL"), selector, verifier)
+
+	err = mailer.New().Send(r.Context(), databaseUser.Username, "Reset your uacl password",
+		fmt.Sprintf("Follow this link to reset your password: %s", resetLink))
+	if err != nil {
+		logger.Error(err)
+	}
+
+	logger.Infof("Issued password reset for %s", databaseUser.Username)
+
+	response.MessageResponseJSON(w, false, http.StatusOK, response.Message{
+		Message: "if that account exists, a reset email has been sent",
+	})
+}
+
+// resetPassword verifies the token issued by forgotPassword, applies the
+// same password policy as account creation, and bumps token_version so every
+// refresh token issued before the reset stops validating.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	body := &resetPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	selector, verifier, ok := splitResetToken(body.Token)
+	if !ok {
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: messages.ErrInvalid.Error(),
+		})
+
+		return
+	}
+
+	reset, err := db.FindPasswordResetBySelector(r.Context(), selector)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if reset.UsedAt.Valid {
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: messages.ErrInvalid.Error(),
+		})
+
+		return
+	}
+
+	if time.Now().After(reset.ExpiresAt) {
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: messages.ErrInvalid.Error(),
+		})
+
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(reset.VerifierHash), []byte(verifier)) != nil {
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: messages.ErrInvalid.Error(),
+		})
+
+		return
+	}
+
+	candidate := &model.User{Username: reset.Username, Password: body.NewPassword}
+
+	target, err := candidate.ValidateCreate()
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{
+			Message: err.Error(),
+			Target:  target,
+		})
+
+		return
+	}
+
+	encryptedPassword := password.CreatePassword(body.NewPassword)
+	if encryptedPassword == "" {
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{
+			Message: messages.ErrInvalid.Error(),
+		})
+
+		return
+	}
+
+	if err := db.UpdatePassword(r.Context(), reset.Username, encryptedPassword); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := db.MarkPasswordResetUsed(r.Context(), selector); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := db.IncrementTokenVersion(r.Context(), reset.Username); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	logger.Infof("Password reset for %s", reset.Username)
+
+	response.MessageResponseJSON(w, false, http.StatusOK, response.Message{Message: "password updated"})
+}
+
+func splitResetToken(token string) (selector, verifier string, ok bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
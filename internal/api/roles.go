@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"uacl/internal/db"
+	"uacl/internal/middlewares"
+
+	"github.com/TomBowyerResearchProject/common/logger"
+	"github.com/TomBowyerResearchProject/common/response"
+	"github.com/go-chi/chi"
+)
+
+// rolesAdminScope gates role management. Its holders are seeded by
+// BootstrapAdminRoles, which grants the admin role to the usernames in
+// ADMIN_USERS, so there's always at least one account able to grant further
+// roles.
+const rolesAdminScope = "roles:admin"
+
+// adminRole is the role BootstrapAdminRoles grants - it must carry
+// rolesAdminScope (along with whatever else an operator wants its holders
+// to have) in whatever maps roles to scopes.
+const adminRole = "admin"
+
+// BootstrapAdminRoles grants adminRole to every username listed in
+// ADMIN_USERS (comma-separated). The deployment entrypoint - this snapshot
+// has none, same as the router AuthoriseScope's doc comment calls out -
+// must call this once at process start, or assignRole/removeRole are
+// unreachable on a fresh deploy: nobody would hold rolesAdminScope to call
+// them with.
+func BootstrapAdminRoles(ctx context.Context) error {
+	raw := os.Getenv("ADMIN_USERS")
+	if raw == "" {
+		return nil
+	}
+
+	for _, username := range strings.Split(raw, ",") {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+
+		if err := db.AssignRole(ctx, username, adminRole); err != nil {
+			return err
+		}
+
+		logger.Infof("Seeded admin role for %s", username)
+	}
+
+	return nil
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+// assignRole grants body.Role to the {username} path param.
+func assignRole(w http.ResponseWriter, r *http.Request) {
+	if _, ok := middlewares.AuthoriseScope(w, r, rolesAdminScope); !ok {
+		return
+	}
+
+	username := chi.URLParam(r, "username")
+
+	body := &roleRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := db.AssignRole(r.Context(), username, body.Role); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	logger.Infof("Granted role %s to %s", body.Role, username)
+	response.MessageResponseJSON(w, false, http.StatusOK, response.Message{Message: "role granted"})
+}
+
+// removeRole revokes body.Role from the {username} path param.
+func removeRole(w http.ResponseWriter, r *http.Request) {
+	if _, ok := middlewares.AuthoriseScope(w, r, rolesAdminScope); !ok {
+		return
+	}
+
+	username := chi.URLParam(r, "username")
+
+	body := &roleRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := db.RevokeRole(r.Context(), username, body.Role); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	logger.Infof("Revoked role %s from %s", body.Role, username)
+	response.MessageResponseJSON(w, false, http.StatusOK, response.Message{Message: "role revoked"})
+}
@@ -0,0 +1,360 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+	"uacl/internal/db"
+	"uacl/internal/password"
+	"uacl/internal/twofactor"
+	"uacl/messages"
+
+	"github.com/TomBowyerResearchProject/common/logger"
+	"github.com/TomBowyerResearchProject/common/response"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	otpChallengePurpose = "otp_challenge"
+	otpChallengeTTL     = 5 * time.Minute
+	otpIssuer           = "uacl"
+)
+
+type otpRequiredResponse struct {
+	Status         string `json:"status"`
+	ChallengeToken string `json:"challenge_token"`
+}
+
+type enrollTwoFactorResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthURL string `json:"otpauth_url"`
+}
+
+type confirmTwoFactorRequest struct {
+	Code string `json:"code"`
+}
+
+type confirmTwoFactorResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type loginOTPRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+type disableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// createOTPChallengeToken mints a short-lived, single-purpose token that
+// proves the caller already presented a correct username/password, without
+// granting access to anything until the OTP step also succeeds.
+func createOTPChallengeToken(username string) (string, error) {
+	private, err := ioutil.ReadFile(os.Getenv("PRIVATE_KEY"))
+	if err != nil {
+		return "", err
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(private)
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"sub":     username,
+		"purpose": otpChallengePurpose,
+		"exp":     time.Now().Add(otpChallengeTTL).Unix(),
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+}
+
+func parseOTPChallengeToken(token string) (string, error) {
+	public, err := ioutil.ReadFile(os.Getenv("PUBLIC_KEY"))
+	if err != nil {
+		return "", err
+	}
+
+	key, err := jwt.ParseRSAPublicKeyFromPEM(public)
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := jwt.Parse(token, func(jwtToken *jwt.Token) (interface{}, error) {
+		if _, ok := jwtToken.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, messages.ErrUnexpectedMethod
+		}
+
+		return key, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok || !parsed.Valid || claims["purpose"] != otpChallengePurpose {
+		return "", messages.ErrInvalid
+	}
+
+	username, ok := claims["sub"].(string)
+	if !ok {
+		return "", messages.ErrInvalid
+	}
+
+	return username, nil
+}
+
+// enrollTwoFactor starts TOTP enrollment for the authenticated user. The
+// secret is stored unconfirmed until confirmTwoFactor verifies a live code.
+// Rejected outright once TOTP is already enabled - disableTwoFactor's
+// password+OTP proof is the only way to clear the way for a re-enrollment,
+// so a bearer token alone can't silently swap out a victim's secret.
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := doAuthentication(r)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrUnauthorised.Error(),
+		})
+
+		return
+	}
+
+	databaseUser, err := db.FindByUsername(r.Context(), user.Username)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if databaseUser.TOTPEnabled {
+		response.MessageResponseJSON(w, false, http.StatusConflict, response.Message{
+			Message: messages.ErrTwoFactorAlreadyEnabled.Error(),
+		})
+
+		return
+	}
+
+	secret, err := twofactor.GenerateSecret()
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if err := db.SetPendingTOTPSecret(r.Context(), user.Username, secret); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	response.ResultResponseJSON(w, false, http.StatusOK, enrollTwoFactorResponse{
+		Secret:     secret,
+		OtpauthURL: twofactor.URI(otpIssuer, user.Username, secret),
+	})
+}
+
+// confirmTwoFactor activates 2FA once the user proves they can generate a
+// valid code from the pending secret, and hands back one-time recovery codes.
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := doAuthentication(r)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrUnauthorised.Error(),
+		})
+
+		return
+	}
+
+	body := &confirmTwoFactorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	code, err := twofactor.ParseCode(body.Code)
+	if err != nil {
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	databaseUser, err := db.FindByUsername(r.Context(), user.Username)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if databaseUser.TOTPEnabled {
+		response.MessageResponseJSON(w, false, http.StatusConflict, response.Message{
+			Message: messages.ErrTwoFactorAlreadyEnabled.Error(),
+		})
+
+		return
+	}
+
+	if !twofactor.Validate(databaseUser.PendingTOTPSecret, code) {
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrInvalidCredentials.Error(),
+		})
+
+		return
+	}
+
+	plaintextCodes, hashedCodes, err := twofactor.GenerateRecoveryCodes()
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	err = db.EnableTOTP(r.Context(), user.Username, databaseUser.PendingTOTPSecret, hashedCodes)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	logger.Infof("Enabled two factor authentication for %s", user.Username)
+
+	response.ResultResponseJSON(w, false, http.StatusOK, confirmTwoFactorResponse{RecoveryCodes: plaintextCodes})
+}
+
+// loginOTP completes a login started by login() when 2FA is enabled,
+// accepting either a live TOTP code or a single-use recovery code. It's
+// gated by the same loginThrottle as login, since a held challenge token
+// otherwise lets the 6-digit code be brute-forced unthrottled. The challenge
+// token (not the request body) is where the username comes from, so Allow
+// is only checked against the ip-only key until it's decoded - then against
+// the "ip|username" key every RecordFailure below also uses, so the two
+// stay in sync.
+func loginOTP(w http.ResponseWriter, r *http.Request) {
+	if !loginThrottle.Allow(w, r, "") {
+		return
+	}
+
+	body := &loginOTPRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	username, err := parseOTPChallengeToken(body.ChallengeToken)
+	if err != nil {
+		logger.Error(err)
+		loginThrottle.RecordFailure(r, "")
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if !loginThrottle.Allow(w, r, username) {
+		return
+	}
+
+	databaseUser, err := db.FindByUsername(r.Context(), username)
+	if err != nil {
+		logger.Error(err)
+		loginThrottle.RecordFailure(r, username)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if twofactor.Validate(databaseUser.TOTPSecret, body.Code) {
+		passTokenToUser(r.Context(), w, &databaseUser)
+
+		return
+	}
+
+	if index, ok := twofactor.MatchRecoveryCode(databaseUser.RecoveryCodeHashes, body.Code); ok {
+		if err := db.ConsumeRecoveryCode(r.Context(), username, index); err != nil {
+			logger.Error(err)
+			response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+			return
+		}
+
+		passTokenToUser(r.Context(), w, &databaseUser)
+
+		return
+	}
+
+	loginThrottle.RecordFailure(r, username)
+	response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+		Message: messages.ErrInvalidCredentials.Error(),
+	})
+}
+
+// disableTwoFactor requires both the account password and a valid OTP so an
+// attacker holding only one factor can't turn off the other.
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := doAuthentication(r)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrUnauthorised.Error(),
+		})
+
+		return
+	}
+
+	body := &disableTwoFactorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	databaseUser, err := db.FindByUsername(r.Context(), user.Username)
+	if err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusBadRequest, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	if !password.ValidatePassword(body.Password, databaseUser.Password) {
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrInvalidCredentials.Error(),
+		})
+
+		return
+	}
+
+	if !twofactor.Validate(databaseUser.TOTPSecret, body.Code) {
+		response.MessageResponseJSON(w, false, http.StatusUnauthorized, response.Message{
+			Message: messages.ErrInvalidCredentials.Error(),
+		})
+
+		return
+	}
+
+	if err := db.DisableTOTP(r.Context(), user.Username); err != nil {
+		logger.Error(err)
+		response.MessageResponseJSON(w, false, http.StatusInternalServerError, response.Message{Message: err.Error()})
+
+		return
+	}
+
+	logger.Infof("Disabled two factor authentication for %s", user.Username)
+
+	response.MessageResponseJSON(w, false, http.StatusOK, response.Message{Message: "two factor authentication disabled"})
+}
@@ -1,10 +1,11 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
 	"os"
 	"time"
+	"uacl/internal/db"
 	"uacl/messages"
 	"uacl/model"
 
@@ -14,33 +15,40 @@ import (
 
 const expirationTime = 100000
 
-func CreateToken(user model.User) (string, error) {
+func CreateToken(user model.User, refresh bool) (string, error) {
 	expiresAt := time.Now().Add(time.Minute * expirationTime).Unix()
 
 	now := time.Now().UTC()
 
 	short := model.ShortenedUser{
-		Name:     user.Name,
-		Username: user.Username,
+		Name:         user.Name,
+		Username:     user.Username,
+		TokenVersion: user.TokenVersion,
+		Roles:        user.Roles,
+		Scopes:       user.Scopes,
+	}
+
+	tokenType := "access"
+	if refresh {
+		tokenType = "refresh"
 	}
 
 	claims := make(jwt.MapClaims)
 	claims["dat"] = short
+	claims["typ"] = tokenType
 	claims["exp"] = expiresAt
 	claims["iat"] = now.Unix()
 	claims["nbf"] = now.Unix()
 
-	private, err := ioutil.ReadFile(os.Getenv("PRIVATE_KEY"))
+	key, err := keyring.SigningKey()
 	if err != nil {
 		return "", err
 	}
 
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(private)
-	if err != nil {
-		return "", err
-	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
 
-	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	tokenString, err := token.SignedString(key.Sign)
 	if err != nil {
 		return "", err
 	}
@@ -50,25 +58,73 @@ func CreateToken(user model.User) (string, error) {
 	return tokenString, nil
 }
 
-func Validate(token string) (model.ShortenedUser, error) {
-	var shorten model.ShortenedUser
+// CreateIDToken mints an OIDC ID token for the given client and nonce,
+// signed with the same key (and kid) as regular access tokens.
+func CreateIDToken(user model.User, clientID, nonce string) (string, error) {
+	expiresAt := time.Now().Add(time.Minute * expirationTime).Unix()
 
-	public, err := ioutil.ReadFile(os.Getenv("PUBLIC_KEY"))
+	now := time.Now().UTC()
+
+	claims := make(jwt.MapClaims)
+	claims["iss"] = os.Getenv("OIDC_ISSUER")
+	claims["sub"] = user.Username
+	claims["aud"] = clientID
+	claims["exp"] = expiresAt
+	claims["iat"] = now.Unix()
+	claims["name"] = user.Name
+	claims["preferred_username"] = user.Username
+
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	key, err := keyring.SigningKey()
 	if err != nil {
-		return shorten, err
+		return "", err
 	}
 
-	key, err := jwt.ParseRSAPublicKeyFromPEM(public)
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	tokenString, err := token.SignedString(key.Sign)
 	if err != nil {
-		return shorten, err
+		return "", err
 	}
 
+	logger.Info("Successfully created id token")
+
+	return tokenString, nil
+}
+
+// SigningAlg returns the JWT "alg" new tokens are currently signed with.
+func SigningAlg() (string, error) {
+	return keyring.SigningAlg()
+}
+
+// Validate decodes and verifies token, only checking token_version against
+// the database for refresh tokens - that's the only grant password reset
+// revokes. Access tokens skip the round trip, since it runs on every
+// authenticated request, and since a client_credentials access token's
+// subject is a client ID with no users row to look up.
+func Validate(ctx context.Context, token string) (model.ShortenedUser, error) {
+	var shorten model.ShortenedUser
+
 	tok, err := jwt.Parse(token, func(jwtToken *jwt.Token) (interface{}, error) {
-		if _, ok := jwtToken.Method.(*jwt.SigningMethodRSA); !ok {
+		kid, ok := jwtToken.Header["kid"].(string)
+		if !ok {
+			return nil, messages.ErrUnknownKeyID
+		}
+
+		key, err := keyring.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if jwtToken.Method.Alg() != key.Method.Alg() {
 			return nil, messages.ErrUnexpectedMethod
 		}
 
-		return key, nil
+		return key.Verify, nil
 	})
 	if err != nil {
 		return shorten, err
@@ -89,6 +145,17 @@ func Validate(token string) (model.ShortenedUser, error) {
 		return shorten, err
 	}
 
+	if claims["typ"] == "refresh" {
+		currentVersion, err := db.CurrentTokenVersion(ctx, shorten.Username)
+		if err != nil {
+			return shorten, err
+		}
+
+		if shorten.TokenVersion != currentVersion {
+			return shorten, messages.ErrTokenRevoked
+		}
+	}
+
 	logger.Info("Successfully validated token")
 
 	return shorten, nil
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+
+	"uacl/messages"
+)
+
+// JWK is a single entry of a JSON Web Key Set, RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+const defaultKeyID = "default"
+
+// JWKS advertises every asymmetric key the keyring currently knows how to
+// verify with, including keys kept around for a rotation, so downstream
+// services can verify tokens issued by this server without sharing a PEM
+// out of band.
+func JWKS() (JWKSet, error) {
+	keys, err := keyring.All()
+	if err != nil {
+		return JWKSet{}, err
+	}
+
+	set := JWKSet{Keys: make([]JWK, 0, len(keys))}
+
+	for _, key := range keys {
+		jwk, err := toJWK(key)
+		if err != nil {
+			return JWKSet{}, err
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set, nil
+}
+
+func toJWK(key Key) (JWK, error) {
+	switch public := key.Verify.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: key.Method.Alg(),
+			Kid: key.ID,
+			N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		return JWK{
+			Kty: "EC",
+			Use: "sig",
+			Alg: key.Method.Alg(),
+			Kid: key.ID,
+			Crv: public.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(public.X.Bytes()),
+			Y:   base64.RawURLEncoding.EncodeToString(public.Y.Bytes()),
+		}, nil
+	default:
+		return JWK{}, messages.ErrUnexpectedMethod
+	}
+}
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"uacl/messages"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const defaultKeyCacheTTL = 5 * time.Minute
+
+// Key is the key material a KeyProvider hands back, paired with the kid and
+// signing method it should be used with. Sign is nil for verification-only
+// keys (an old key kept around during a rotation).
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	Sign   interface{}
+	Verify interface{}
+}
+
+// KeyProvider loads the key tokens are currently signed with, plus any
+// previously-active keys that should still verify, so a signing key can be
+// rotated with overlap instead of invalidating every outstanding token.
+type KeyProvider interface {
+	Load() (current Key, previous []Key, err error)
+}
+
+// FileKeyProvider loads an RSA key pair from PEM files on disk, matching the
+// PRIVATE_KEY/PUBLIC_KEY environment variables uacl has always used. Older
+// public keys can be kept verifying during a rotation via PREVIOUS_PUBLIC_KEYS,
+// a comma-separated list of "kid=path" pairs.
+type FileKeyProvider struct{}
+
+func (FileKeyProvider) Load() (Key, []Key, error) {
+	private, err := ioutil.ReadFile(os.Getenv("PRIVATE_KEY"))
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	signKey, err := jwt.ParseRSAPrivateKeyFromPEM(private)
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	public, err := ioutil.ReadFile(os.Getenv("PUBLIC_KEY"))
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	verifyKey, err := jwt.ParseRSAPublicKeyFromPEM(public)
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	current := Key{
+		ID:     envOrDefault("KEY_ID", defaultKeyID),
+		Method: jwt.SigningMethodRS256,
+		Sign:   signKey,
+		Verify: verifyKey,
+	}
+
+	previous, err := loadPreviousRSAKeys()
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	return current, previous, nil
+}
+
+func loadPreviousRSAKeys() ([]Key, error) {
+	raw := os.Getenv("PREVIOUS_PUBLIC_KEYS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var keys []Key
+
+	for _, entry := range strings.Split(raw, ",") {
+		kid, path, ok := splitKeyEntry(entry)
+		if !ok {
+			continue
+		}
+
+		public, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		verifyKey, err := jwt.ParseRSAPublicKeyFromPEM(public)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, Key{ID: kid, Method: jwt.SigningMethodRS256, Verify: verifyKey})
+	}
+
+	return keys, nil
+}
+
+// ESKeyProvider loads an ECDSA key pair for ES256, for operators who'd
+// rather not keep an RSA private key online.
+type ESKeyProvider struct{}
+
+func (ESKeyProvider) Load() (Key, []Key, error) {
+	private, err := ioutil.ReadFile(os.Getenv("JWT_ES256_PRIVATE_KEY"))
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	signKey, err := jwt.ParseECPrivateKeyFromPEM(private)
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	public, err := ioutil.ReadFile(os.Getenv("JWT_ES256_PUBLIC_KEY"))
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	verifyKey, err := jwt.ParseECPublicKeyFromPEM(public)
+	if err != nil {
+		return Key{}, nil, err
+	}
+
+	current := Key{
+		ID:     envOrDefault("JWT_ES256_KEY_ID", "es-default"),
+		Method: jwt.SigningMethodES256,
+		Sign:   signKey,
+		Verify: verifyKey,
+	}
+
+	return current, nil, nil
+}
+
+// HS256KeyProvider signs with a shared secret instead of a key pair, for
+// deployments that don't need cross-service JWKS verification.
+type HS256KeyProvider struct{}
+
+func (HS256KeyProvider) Load() (Key, []Key, error) {
+	secret := os.Getenv("JWT_HS256_SECRET")
+	if secret == "" {
+		return Key{}, nil, fmt.Errorf("JWT_HS256_SECRET not set")
+	}
+
+	current := Key{
+		ID:     envOrDefault("JWT_HS256_KEY_ID", "hs-default"),
+		Method: jwt.SigningMethodHS256,
+		Sign:   []byte(secret),
+		Verify: []byte(secret),
+	}
+
+	return current, nil, nil
+}
+
+// providerForEnv picks a KeyProvider based on JWT_SIGNING_METHOD, defaulting
+// to the file-based RSA provider uacl has always used.
+func providerForEnv() KeyProvider {
+	switch os.Getenv("JWT_SIGNING_METHOD") {
+	case "HS256":
+		return HS256KeyProvider{}
+	case "ES256":
+		return ESKeyProvider{}
+	default:
+		return FileKeyProvider{}
+	}
+}
+
+func splitKeyEntry(entry string) (kid, path string, ok bool) {
+	parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// Keyring caches the keys a KeyProvider loads, so CreateToken and Validate
+// don't re-read a PEM file (or re-derive an EC key) on every request. It's
+// refreshed on a TTL rather than a file watch, so a rotated PREVIOUS_PUBLIC_KEYS
+// or swapped PRIVATE_KEY takes effect within the keyring's ttl
+// (KEY_CACHE_TTL_SECONDS, default defaultKeyCacheTTL) of the operator
+// updating it.
+type Keyring struct {
+	provider KeyProvider
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	loadedAt time.Time
+	current  Key
+	byKid    map[string]Key
+}
+
+// NewKeyring wraps provider with an in-memory cache refreshed every ttl. A
+// zero ttl falls back to defaultKeyCacheTTL.
+func NewKeyring(provider KeyProvider, ttl time.Duration) *Keyring {
+	if ttl <= 0 {
+		ttl = defaultKeyCacheTTL
+	}
+
+	return &Keyring{provider: provider, ttl: ttl}
+}
+
+func (k *Keyring) refresh() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.byKid != nil && time.Since(k.loadedAt) < k.ttl {
+		return nil
+	}
+
+	current, previous, err := k.provider.Load()
+	if err != nil {
+		return err
+	}
+
+	byKid := make(map[string]Key, len(previous)+1)
+	byKid[current.ID] = current
+
+	for _, key := range previous {
+		byKid[key.ID] = key
+	}
+
+	k.current = current
+	k.byKid = byKid
+	k.loadedAt = time.Now()
+
+	return nil
+}
+
+// SigningKey returns the key new tokens should be signed with.
+func (k *Keyring) SigningKey() (Key, error) {
+	if err := k.refresh(); err != nil {
+		return Key{}, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.current, nil
+}
+
+// SigningAlg returns the JWT "alg" of the key new tokens are currently
+// signed with, for callers that need to advertise it rather than assume RS256
+// (e.g. OIDC discovery).
+func (k *Keyring) SigningAlg() (string, error) {
+	key, err := k.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	return key.Method.Alg(), nil
+}
+
+// VerificationKey looks up the key a token claims to have been signed with
+// by its kid header, so a key rotated out of SigningKey can still verify
+// tokens issued before the rotation.
+func (k *Keyring) VerificationKey(kid string) (Key, error) {
+	if err := k.refresh(); err != nil {
+		return Key{}, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.byKid[kid]
+	if !ok {
+		return Key{}, messages.ErrUnknownKeyID
+	}
+
+	return key, nil
+}
+
+// All returns every key the keyring currently knows about, for JWKS. Symmetric
+// HS256 secrets are excluded, since publishing them would defeat the point of
+// a shared secret.
+func (k *Keyring) All() ([]Key, error) {
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make([]Key, 0, len(k.byKid))
+
+	for _, key := range k.byKid {
+		switch key.Verify.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+var keyring = NewKeyring(providerForEnv(), keyCacheTTLFromEnv())
+
+func keyCacheTTLFromEnv() time.Duration {
+	raw := os.Getenv("KEY_CACHE_TTL_SECONDS")
+	if raw == "" {
+		return defaultKeyCacheTTL
+	}
+
+	seconds, err := time.ParseDuration(raw + "s")
+	if err != nil {
+		return defaultKeyCacheTTL
+	}
+
+	return seconds
+}
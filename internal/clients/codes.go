@@ -0,0 +1,132 @@
+package clients
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+const codeLifetime = 2 * time.Minute
+
+var (
+	ErrCodeNotFound = errors.New("authorization code not found")
+	ErrCodeExpired  = errors.New("authorization code expired")
+	ErrCodeUsed     = errors.New("authorization code already used")
+	ErrPKCEMismatch = errors.New("pkce code_verifier does not match code_challenge")
+)
+
+// AuthorizationCode is the short-lived, single-use state issued from /authorize
+// and redeemed at /token for the authorization_code grant.
+type AuthorizationCode struct {
+	Code                string
+	ClientID            string
+	Username            string
+	RedirectURI         string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ExpiresAt           time.Time
+	UsedAt              sql.NullTime
+}
+
+// CodeStore persists authorization codes for the duration of the OAuth2 dance.
+type CodeStore struct {
+	db *sql.DB
+}
+
+func NewCodeStore(db *sql.DB) *CodeStore {
+	return &CodeStore{db: db}
+}
+
+func (s *CodeStore) Create(ctx context.Context, code AuthorizationCode) error {
+	code.ExpiresAt = code.ExpiresAt.UTC()
+
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO authorization_codes
+			(code, client_id, username, redirect_uri, scope, nonce, code_challenge, code_challenge_method, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		code.Code, code.ClientID, code.Username, code.RedirectURI, code.Scope,
+		code.Nonce, code.CodeChallenge, code.CodeChallengeMethod, code.ExpiresAt,
+	)
+
+	return err
+}
+
+// Redeem atomically claims a code - via a conditional UPDATE, so two
+// concurrent requests presenting the same code can't both see it unused -
+// then loads it and verifies the optional PKCE code_verifier.
+func (s *CodeStore) Redeem(ctx context.Context, rawCode, codeVerifier string) (AuthorizationCode, error) {
+	var code AuthorizationCode
+
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE authorization_codes SET used_at = now() WHERE code = $1 AND used_at IS NULL`,
+		rawCode,
+	)
+	if err != nil {
+		return code, err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return code, err
+	}
+
+	row := s.db.QueryRowContext(ctx,
+		`SELECT code, client_id, username, redirect_uri, scope, nonce, code_challenge, code_challenge_method,
+			expires_at, used_at
+		FROM authorization_codes WHERE code = $1`,
+		rawCode,
+	)
+
+	err = row.Scan(
+		&code.Code, &code.ClientID, &code.Username, &code.RedirectURI, &code.Scope, &code.Nonce,
+		&code.CodeChallenge, &code.CodeChallengeMethod, &code.ExpiresAt, &code.UsedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return code, ErrCodeNotFound
+	}
+
+	if err != nil {
+		return code, err
+	}
+
+	if claimed == 0 {
+		return code, ErrCodeUsed
+	}
+
+	if time.Now().After(code.ExpiresAt) {
+		return code, ErrCodeExpired
+	}
+
+	if code.CodeChallenge != "" && !verifyPKCE(code.CodeChallenge, code.CodeChallengeMethod, codeVerifier) {
+		return code, ErrPKCEMismatch
+	}
+
+	return code, nil
+}
+
+func verifyPKCE(challenge, method, verifier string) bool {
+	if method == "" {
+		method = "plain"
+	}
+
+	switch method {
+	case "plain":
+		return verifier == challenge
+	case "S256":
+		sum := sha256.Sum256([]byte(verifier))
+
+		return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+	default:
+		return false
+	}
+}
+
+// NewExpiry returns the expiry timestamp a freshly minted code should carry.
+func NewExpiry() time.Time {
+	return time.Now().Add(codeLifetime)
+}
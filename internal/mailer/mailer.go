@@ -0,0 +1,65 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+
+	"github.com/TomBowyerResearchProject/common/logger"
+)
+
+// Mailer sends a single plain-text email. Implementations are swapped via
+// New based on environment configuration, so the same call sites work in
+// both production (SMTP) and local development (log only).
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// New picks an SMTP mailer when SMTP_HOST is configured, and otherwise
+// falls back to a mailer that just logs the message, so password resets and
+// other notifications work out of the box in local development.
+func New() Mailer {
+	if os.Getenv("SMTP_HOST") == "" {
+		return LogMailer{}
+	}
+
+	return SMTPMailer{
+		host: os.Getenv("SMTP_HOST"),
+		port: os.Getenv("SMTP_PORT"),
+		from: os.Getenv("MAIL_FROM"),
+		user: os.Getenv("SMTP_USER"),
+		pass: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+// SMTPMailer sends mail through a configured SMTP relay.
+type SMTPMailer struct {
+	host string
+	port string
+	from string
+	user string
+	pass string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	addr := fmt.Sprintf("%s:%s", m.host, m.port)
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", m.from, to, subject, body)
+
+	var auth smtp.Auth
+	if m.user != "" {
+		auth = smtp.PlainAuth("", m.user, m.pass, m.host)
+	}
+
+	return smtp.SendMail(addr, auth, m.from, []string{to}, []byte(message))
+}
+
+// LogMailer logs the email instead of sending it, for local development.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, to, subject, body string) error {
+	logger.Infof("Not sending email (no SMTP_HOST configured): to=%s subject=%s body=%s", to, subject, body)
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TomBowyerResearchProject/common/logger"
+	"github.com/TomBowyerResearchProject/common/response"
+)
+
+const (
+	defaultLoginMaxAttempts = 5
+	defaultLoginWindow      = 300 * time.Second
+)
+
+// Counter tracks how many hits a key has seen within its configured window,
+// returning the updated count and the time remaining before it resets.
+type Counter interface {
+	Incr(ctx context.Context, key string) (count int64, ttl time.Duration, err error)
+
+	// Peek reports the key's current count and remaining window without
+	// recording a hit, so callers can check a limit without counting the
+	// check itself as an attempt.
+	Peek(ctx context.Context, key string) (count int64, ttl time.Duration, err error)
+}
+
+// MemoryCounter is an in-memory sliding window, and the counter the api
+// package's loginThrottle is built with. It's per-process, so it only
+// protects a single instance.
+type MemoryCounter struct {
+	mu     sync.Mutex
+	hits   map[string][]time.Time
+	window time.Duration
+}
+
+func NewMemoryCounter(window time.Duration) *MemoryCounter {
+	return &MemoryCounter{
+		hits:   make(map[string][]time.Time),
+		window: window,
+	}
+}
+
+func (m *MemoryCounter) Incr(_ context.Context, key string) (int64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-m.window)
+
+	kept := m.hits[key][:0]
+
+	for _, hit := range m.hits[key] {
+		if hit.After(cutoff) {
+			kept = append(kept, hit)
+		}
+	}
+
+	kept = append(kept, now)
+	m.hits[key] = kept
+
+	ttl := m.window
+	if len(kept) > 0 {
+		ttl = m.window - now.Sub(kept[0])
+	}
+
+	return int64(len(kept)), ttl, nil
+}
+
+func (m *MemoryCounter) Peek(_ context.Context, key string) (int64, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-m.window)
+
+	var count int64
+
+	var oldest time.Time
+
+	for _, hit := range m.hits[key] {
+		if hit.After(cutoff) {
+			if count == 0 {
+				oldest = hit
+			}
+
+			count++
+		}
+	}
+
+	ttl := m.window
+	if count > 0 {
+		ttl = m.window - now.Sub(oldest)
+	}
+
+	return count, ttl, nil
+}
+
+// RedisClient is the minimal surface LoginThrottle needs from a Redis
+// client, so operators can plug in whichever Redis library they already
+// depend on elsewhere without this package hard-depending on one.
+type RedisClient interface {
+	Incr(ctx context.Context, key string) (int64, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	TTL(ctx context.Context, key string) (time.Duration, error)
+
+	// Get returns the key's current value, or 0 with no error if it isn't set.
+	Get(ctx context.Context, key string) (int64, error)
+}
+
+// RedisCounter is a Counter backed by a shared Redis instance, so the
+// window is enforced across every uacl replica. Unlike MemoryCounter its
+// window is fixed, not sliding: it starts at a key's first hit and the whole
+// count resets when the key expires.
+type RedisCounter struct {
+	client RedisClient
+	window time.Duration
+}
+
+func NewRedisCounter(client RedisClient, window time.Duration) *RedisCounter {
+	return &RedisCounter{client: client, window: window}
+}
+
+func (r *RedisCounter) Incr(ctx context.Context, key string) (int64, time.Duration, error) {
+	count, err := r.client.Incr(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if count == 1 {
+		if err := r.client.Expire(ctx, key, r.window); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	ttl, err := r.client.TTL(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, ttl, nil
+}
+
+func (r *RedisCounter) Peek(ctx context.Context, key string) (int64, time.Duration, error) {
+	count, err := r.client.Get(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ttl, err := r.client.TTL(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, ttl, nil
+}
+
+// LoginThrottle rate limits login, refresh and autologin attempts per
+// (ip, username) using LOGIN_MAX_ATTEMPTS failures within LOGIN_WINDOW_SECONDS.
+type LoginThrottle struct {
+	counter     Counter
+	maxAttempts int64
+}
+
+// NewLoginThrottle reads LOGIN_MAX_ATTEMPTS. It doesn't read
+// LOGIN_WINDOW_SECONDS: the window is whatever counter was built with (see
+// LoginWindow).
+func NewLoginThrottle(counter Counter) *LoginThrottle {
+	return &LoginThrottle{
+		counter:     counter,
+		maxAttempts: envInt("LOGIN_MAX_ATTEMPTS", defaultLoginMaxAttempts),
+	}
+}
+
+// LoginWindow reads LOGIN_WINDOW_SECONDS, for callers constructing a
+// MemoryCounter or RedisCounter to back a LoginThrottle.
+func LoginWindow() time.Duration {
+	return time.Duration(envInt("LOGIN_WINDOW_SECONDS", int64(defaultLoginWindow.Seconds()))) * time.Second
+}
+
+func envInt(name string, fallback int64) int64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// Middleware keys attempts by client IP and, when the request body carries
+// a "username" field (as /login does), by username too, so a credential
+// stuffing run against one account doesn't also throttle every other user
+// behind the same IP.
+func (l *LoginThrottle) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow(w, r, peekUsername(r)) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Allow reports whether r is still within the window for username (pass ""
+// if the request has none), writing the 429 response itself and returning
+// false when it isn't. It only inspects the window; call RecordFailure with
+// the same username after a failed attempt so it counts toward the next
+// check. Resolve the username before calling either - reading the body
+// twice (once here, once to decode it) loses it the second time.
+func (l *LoginThrottle) Allow(w http.ResponseWriter, r *http.Request, username string) bool {
+	count, ttl, err := l.counter.Peek(r.Context(), "login:"+throttleKey(r, username))
+	if err != nil {
+		logger.Error(err)
+
+		return true
+	}
+
+	if count >= l.maxAttempts {
+		w.Header().Set("Retry-After", strconv.Itoa(int(ttl.Seconds())))
+		response.MessageResponseJSON(w, false, http.StatusTooManyRequests, response.Message{
+			Message: "too many attempts, try again later",
+		})
+
+		return false
+	}
+
+	return true
+}
+
+// RecordFailure counts a failed login, refresh or autologin attempt against
+// r's window, so repeated failures eventually trip Allow. Successful
+// attempts must not call this, or they'd throttle legitimate users out.
+func (l *LoginThrottle) RecordFailure(r *http.Request, username string) {
+	if _, _, err := l.counter.Incr(r.Context(), "login:"+throttleKey(r, username)); err != nil {
+		logger.Error(err)
+	}
+}
+
+func throttleKey(r *http.Request, username string) string {
+	key := clientIP(r)
+
+	if username != "" {
+		key += "|" + username
+	}
+
+	return key
+}
+
+// clientIP returns the request's originating address, without the ephemeral
+// port RemoteAddr carries - leaving the port in would give every new TCP
+// connection its own throttle key, letting an attacker dodge the limit by
+// simply reconnecting. X-Forwarded-For is only trusted when
+// TRUST_PROXY_HEADERS is set, i.e. uacl sits behind a known reverse proxy
+// that sets rather than appends to the header - otherwise a client could
+// spoof the header to get a fresh throttle key on every request.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") != "" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hop := forwarded
+			if idx := strings.IndexByte(forwarded, ','); idx != -1 {
+				hop = forwarded[:idx]
+			}
+
+			return strings.TrimSpace(hop)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func peekUsername(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return ""
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+
+	var body struct {
+		Username string `json:"username"`
+	}
+
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return ""
+	}
+
+	return body.Username
+}
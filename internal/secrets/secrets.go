@@ -0,0 +1,20 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// NewToken returns a URL-safe, base64-encoded string built from nBytes of
+// entropy read from crypto/rand. Use it for anything that needs to be
+// unguessable: autologin tokens, refresh tokens, OAuth authorization codes,
+// password-reset tokens, and any future one-time secret.
+func NewToken(nBytes int) (string, error) {
+	raw := make([]byte, nBytes)
+
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
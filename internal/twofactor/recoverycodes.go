@@ -0,0 +1,52 @@
+package twofactor
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+// GenerateRecoveryCodes returns a fresh set of backup codes along with their
+// bcrypt hashes. Callers store the hashes and show the plaintext codes to
+// the user exactly once.
+func GenerateRecoveryCodes() (plaintext, hashes []string, err error) {
+	plaintext = make([]string, recoveryCodeCount)
+	hashes = make([]string, recoveryCodeCount)
+
+	for i := range plaintext {
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err = rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+		hashed, hashErr := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if hashErr != nil {
+			return nil, nil, hashErr
+		}
+
+		plaintext[i] = code
+		hashes[i] = string(hashed)
+	}
+
+	return plaintext, hashes, nil
+}
+
+// MatchRecoveryCode finds which (if any) hash a submitted recovery code
+// matches, so the caller can mark that single entry used.
+func MatchRecoveryCode(hashes []string, code string) (index int, ok bool) {
+	for i, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return i, true
+		}
+	}
+
+	return -1, false
+}